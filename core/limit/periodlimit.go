@@ -2,34 +2,117 @@ package limit
 
 import (
 	"errors"
+	"fmt"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/tal-tech/go-zero/core/logx"
 	"github.com/tal-tech/go-zero/core/stores/redis"
+	"github.com/tal-tech/go-zero/core/syncx"
 )
 
 const (
-	// to be compatible with aliyun redis, we cannot use `local key = KEYS[1]` to reuse the key
-	// KEYS[1] 访问资源的标示
-	// ARGV[1] limit => 请求总数，超过则限速。可设置为 QPS
-	// ARGV[2] window => 滑动窗口大小，用 ttl 模拟出滑动的效果
-	periodScript = `local limit = tonumber(ARGV[1])
+	zoneDiff = 3600 * 8 // GMT+8 for our services
+
+	// slidingWindowScript 分桶滑动窗口脚本
+	// KEYS[1] 访问资源的标示（hash 结构）
+	// ARGV[1] limit => 请求总数，超过则限速
+	// ARGV[2] window => 时间窗口大小，单位秒
+	// ARGV[3] buckets => 分桶数量，window 按 buckets 等分
+	// 用 redis.call("TIME") 取 redis 侧的时间，避免客户端与 redis 的时钟不一致
+	slidingWindowScript = `local limit = tonumber(ARGV[1])
 local window = tonumber(ARGV[2])
--- incrbt key 1 => key visis++
-local current = redis.call("INCRBY", KEYS[1], 1)
--- 如果是第一次访问，设置过期时间 => TTL = window size
--- 因为是只限制一段时间的访问次数
-if current == 1 then
-    redis.call("expire", KEYS[1], window)
-    return 1
-elseif current < limit then
+local buckets = tonumber(ARGV[3])
+local span = window / buckets
+local time = redis.call("TIME")
+local now = tonumber(time[1])
+local current = now % window / span
+-- 清理掉已经过期的桶，只保留最近一个完整 window 内落入的桶
+for i = 0, buckets - 1 do
+    local idx = tostring(i)
+    local ts = redis.call("HGET", KEYS[1], "_ts:" .. idx)
+    if ts and now - tonumber(ts) >= window then
+        redis.call("HDEL", KEYS[1], idx, "_ts:" .. idx)
+    end
+end
+local total = redis.call("HINCRBY", KEYS[1], tostring(math.floor(current)), 1)
+redis.call("HSET", KEYS[1], "_ts:" .. tostring(math.floor(current)), now)
+redis.call("PEXPIRE", KEYS[1], window * 2 * 1000)
+-- 累加所有存活的桶
+local sum = 0
+local fields = redis.call("HGETALL", KEYS[1])
+for i = 1, #fields, 2 do
+    if not string.find(fields[i], "_ts:") then
+        sum = sum + tonumber(fields[i + 1])
+    end
+end
+if sum < limit then
     return 1
-elseif current == limit then
+elseif sum == limit then
     return 2
 else
     return 0
 end`
-	zoneDiff = 3600 * 8 // GMT+8 for our services
+
+	// zsetSlidingWindowScript 基于 ZSET 记录每次请求时间戳的滑动窗口脚本，
+	// 精确到毫秒级，代价是每个 key 需要保存 quota 个成员
+	// KEYS[1] 访问资源的标示（zset 结构）
+	// ARGV[1] limit => 请求总数，超过则限速
+	// ARGV[2] window => 时间窗口大小，单位秒
+	zsetSlidingWindowScript = `local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+redis.call("ZREMRANGEBYSCORE", KEYS[1], 0, now - window * 1000)
+local current = redis.call("ZCARD", KEYS[1])
+if current < limit then
+    redis.call("ZADD", KEYS[1], now, now .. "-" .. tostring(math.random()))
+    redis.call("PEXPIRE", KEYS[1], window * 1000)
+    if current + 1 == limit then
+        return 2
+    end
+    return 1
+else
+    return 0
+end`
+
+	// takeNScript 一次性预占 n 个配额的脚本，KEYS[1] 返回 {code, remaining, pttl, exhausted}
+	// ARGV[1] limit => 请求总数，超过则限速
+	// ARGV[2] window => 时间窗口大小，单位秒
+	// ARGV[3] n => 本次请求预占的配额数
+	// 是否是这个 key 第一次写入用 TTL 是否已设置来判断，而不是 current == n：
+	// 如果用 current == n 判断，一个反复发起超额预占（n > quota）的调用方会在每次
+	// "INCRBY 再 DECRBY 回滚" 之后都把计数器重新归零，下一次预占又会命中 current == n，
+	// 导致 expire 被反复重新设置，窗口的真实过期时间永远推进不到，TTL 被无限续期。
+	// exhausted 只在 OverQuota 时有意义，标记配额是不是真的已经见底（before >= limit），
+	// 而不只是这一次请求的 n 超过了当时剩余的配额——后者不该让调用方触发负缓存，
+	// 否则一次性要太多配额的请求会顺带把本该还能放行的小额请求也挡在外面
+	takeNScript = `local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local fresh = redis.call("TTL", KEYS[1]) < 0
+local current = redis.call("INCRBY", KEYS[1], n)
+if fresh then
+    redis.call("expire", KEYS[1], window)
+end
+if current > limit then
+    -- 回滚多占的配额，避免部分超额的请求污染其他调用方的计数
+    redis.call("DECRBY", KEYS[1], n)
+    local before = current - n
+    local exhausted = 0
+    if before >= limit then
+        exhausted = 1
+    end
+    return {0, 0, redis.call("PTTL", KEYS[1]), exhausted}
+end
+local remaining = limit - current
+if current == limit then
+    return {2, remaining, redis.call("PTTL", KEYS[1]), 0}
+else
+    return {1, remaining, redis.call("PTTL", KEYS[1]), 0}
+end`
 )
 
 const (
@@ -50,10 +133,47 @@ const (
 	internalHitQuota = 2
 )
 
+const (
+	// windowModeFixed 默认模式，固定窗口计数器，即最初的 INCRBY + expire
+	windowModeFixed = iota
+	// windowModeSlidingBucket 分桶滑动窗口，用 hash 存每个桶的计数
+	windowModeSlidingBucket
+	// windowModeSlidingZSet 基于 zset 的滑动窗口，精确到每一次请求的时间戳
+	windowModeSlidingZSet
+)
+
 // ErrUnknownCode 未知错误类型
 var ErrUnknownCode = errors.New("unknown status code")
 
+// ErrInvalidTakeCount TakeN 的 n 不合法，n 必须 >= 1，
+// 否则负数会让 Lua 脚本里的 INCRBY/DECRBY 反向操作，悄悄把配额还给其他调用方
+var ErrInvalidTakeCount = errors.New("limit: n must be greater than 0")
+
+// ErrTakeNUnsupportedWindowMode TakeN/Allow 只支持固定窗口，分桶/zset 滑动窗口
+// 的脚本不认识"预占 n 个配额"这个语义，请在这两种模式下继续用 Take。
+// 这里直接拒绝，而不是静默地用 takeNScript 跑一个假的固定窗口计数——那样会在
+// 同一个 key 上和 Take 写的 HASH/ZSET 打架，触发 WRONGTYPE，被当成 redis 故障处理
+var ErrTakeNUnsupportedWindowMode = errors.New("limit: TakeN/Allow only supports the fixed window mode")
+
+// 确保 PeriodLimit 实现了 Limiter 接口
+var _ Limiter = (*PeriodLimit)(nil)
+
 type (
+	// Result 统一的限流结果，State 取值与 Take/TakeN 的返回值一致，
+	// Remaining 为本次请求之后窗口内剩余的配额，ResetAt 为窗口重置的时间点，
+	// 供 HTTP/gRPC 等传输层中间件拼装 X-RateLimit-* 响应头使用
+	Result struct {
+		State     int
+		Remaining int
+		ResetAt   time.Time
+	}
+
+	// Limiter 统一的限流器接口，抽象不同的限流算法（固定窗口、滑动窗口、令牌桶等），
+	// 使上层调用方（中间件、拦截器）可以用同一种方式接入任意一种限流实现
+	Limiter interface {
+		Allow(key string) (Result, error)
+	}
+
 	// LimitOption 添加附加选项的方法，目前只提供了一个校准时区的功能
 	LimitOption func(l *PeriodLimit)
 
@@ -63,8 +183,8 @@ type (
 		period int
 		// quota 窗口内允许的请求数
 		quota int
-		// limitStore 窗口控制信息存储的位置，是不是有更美观的方式来设置存储位置？
-		limitStore *redis.Redis
+		// store 窗口控制信息存储的位置，抽象为 Store 接口，便于替换为 redis cluster、内存等后端
+		store Store
 		// keyPrefix 窗口控制信息存储的key的前缀
 		keyPrefix string
 		// align 固定窗口开关，默认为滑动窗口
@@ -84,6 +204,31 @@ type (
 		// 可参考 https://www.infoq.cn/article/Qg2tX8fyw5Vt-f3HH673
 		// 中的1、固定窗口计数器算法的解释
 		align bool
+		// windowMode 窗口算法，默认 windowModeFixed，即固定窗口
+		// 固定窗口在窗口边界处会出现最多2倍quota的突发流量，
+		// 可以通过 WithSlidingWindow 或 WithZSetSlidingWindow 切换为滑动窗口来规避
+		windowMode int
+		// buckets 分桶滑动窗口下的分桶数量，仅 windowModeSlidingBucket 下有意义
+		buckets int
+
+		// redisAlive 标记 redis 是否存活，1 为存活，0 为不可用，通过 atomic 读写
+		redisAlive uint32
+		// rescueLock 保护 monitoring，避免重复启动健康检查协程
+		rescueLock sync.Mutex
+		// monitoring 是否已经有协程在后台探测 redis 是否恢复
+		monitoring bool
+		// localLock 保护 localBuckets 的读写
+		localLock sync.Mutex
+		// localBuckets redis 不可用时，降级为单机计数使用的本地配额，key 为限流的 key
+		localBuckets *syncx.Map
+		// negativeCache 命中 OverQuota 的 key 在窗口剩余时间内不再请求 redis，减少热点 key 的压力
+		negativeCache *syncx.Map
+	}
+
+	// localBucket 单机降级模式下的窗口计数
+	localBucket struct {
+		count   int
+		resetAt time.Time
 	}
 )
 
@@ -93,30 +238,92 @@ type (
 // limitStore *redis.Redis 滑动窗口控制信息存储的位置
 // keyPrefix string 滑动窗口控制信息存储的key的前缀
 // opts ...LimitOption
+// 底层固定用 redis 存储，如果要换成其他存储后端请用 NewPeriodLimitWithStore
 func NewPeriodLimit(period, quota int, limitStore *redis.Redis, keyPrefix string,
+	opts ...LimitOption) *PeriodLimit {
+	return NewPeriodLimitWithStore(period, quota, NewRedisStore(limitStore), keyPrefix, opts...)
+}
+
+// NewPeriodLimitWithStore 创建窗口限流器实例（默认为固定窗口），可以传入任意 Store 实现作为存储后端，
+// 比如 redis cluster、进程内内存（单测用）或者迁移用的 MultiStore。
+// 如果 store 不支持所选的窗口模式（比如 memoryStore 配 WithSlidingWindow），
+// 这里会直接 panic，而不是留到第一次 Take 时才在运行时报错
+func NewPeriodLimitWithStore(period, quota int, store Store, keyPrefix string,
 	opts ...LimitOption) *PeriodLimit {
 	limiter := &PeriodLimit{
-		period:     period,
-		quota:      quota,
-		limitStore: limitStore,
-		keyPrefix:  keyPrefix,
+		period:        period,
+		quota:         quota,
+		store:         store,
+		keyPrefix:     keyPrefix,
+		redisAlive:    1,
+		localBuckets:  syncx.NewMap(),
+		negativeCache: syncx.NewMap(),
 	}
 
 	for _, opt := range opts {
 		opt(limiter)
 	}
 
+	if s, ok := store.(windowModeSupporter); ok && !s.supportsWindowMode(limiter.windowMode) {
+		panic(fmt.Sprintf("limit: store %T does not support this window mode, use redis for sliding window modes", store))
+	}
+	if limiter.windowMode == windowModeSlidingBucket && limiter.buckets < 1 {
+		// buckets == 0 让脚本里 span = window/buckets 变成 +inf，所有请求都落进同一个
+		// bucket，而清理旧桶的 `for i = 0, buckets - 1` 循环 (`for i = 0, -1`) 一次都不会跑，
+		// key 会在命中配额之后被 PEXPIRE 无限续期，永远恢复不了
+		panic(fmt.Sprintf("limit: buckets must be >= 1 for WithSlidingWindow, got %d", limiter.buckets))
+	}
+
 	return limiter
 }
 
 // Take 获取访问状态
 // 当访问成功时返回值为下列任意一个: Allowed|HitQuota|OverQuota
 // 当访问失败时返回 Unknown 和错误信息
+// redis 不可用时会自动降级为单机计数，并在后台探测 redis 恢复后切回分布式计数
 func (h *PeriodLimit) Take(key string) (int, error) {
-	resp, err := h.limitStore.Eval(periodScript, []string{h.keyPrefix + key}, []string{
-		strconv.Itoa(h.quota),
-		strconv.Itoa(h.calcExpireSeconds()),
-	})
+	// 固定窗口复用 TakeN(key, 1)，这样 Redis 故障降级、负缓存两套逻辑只维护一份，
+	// 且负缓存的过期时间可以取 takeNScript 返回的真实 PTTL
+	if h.windowMode == windowModeFixed {
+		state, _, _, err := h.TakeN(key, 1)
+		return state, err
+	}
+
+	if atomic.LoadUint32(&h.redisAlive) == 0 {
+		return h.takeLocally(key), nil
+	}
+
+	code, err := h.takeSlidingRemotely(key)
+	if err != nil {
+		logx.Errorf("period limit fall back to local limiter, key: %s, error: %v", key, err)
+		atomic.StoreUint32(&h.redisAlive, 0)
+		h.startRescueMonitor()
+		return h.takeLocally(key), nil
+	}
+
+	return code, nil
+}
+
+// takeSlidingRemotely 通过 redis 做分桶/zset 滑动窗口计数。
+// 滑动窗口没有固定窗口那样单一的重置时刻（桶会持续滚动），算不出一个准确的
+// PTTL，所以这里不对结果做负缓存，只保留 redis 故障时的降级兜底
+func (h *PeriodLimit) takeSlidingRemotely(key string) (int, error) {
+	var resp interface{}
+	var err error
+
+	switch h.windowMode {
+	case windowModeSlidingBucket:
+		resp, err = h.store.Eval(slidingWindowScript, []string{h.keyPrefix + key}, []string{
+			strconv.Itoa(h.quota),
+			strconv.Itoa(h.period),
+			strconv.Itoa(h.buckets),
+		})
+	default:
+		resp, err = h.store.Eval(zsetSlidingWindowScript, []string{h.keyPrefix + key}, []string{
+			strconv.Itoa(h.quota),
+			strconv.Itoa(h.period),
+		})
+	}
 	if err != nil {
 		return Unknown, err
 	}
@@ -138,6 +345,174 @@ func (h *PeriodLimit) Take(key string) (int, error) {
 	}
 }
 
+// takeLocally 单机降级计数，每个进程各自维护配额，redis 恢复之前只能做到尽力而为
+func (h *PeriodLimit) takeLocally(key string) int {
+	state, _, _ := h.takeLocallyN(key, 1)
+	return state
+}
+
+// takeLocallyN 单机降级模式下一次性预占 n 个配额，语义与 TakeN 对齐：
+// 配额不够时整个 n 都不占用，而不是先加后允许透支，与 takeNScript 的回滚行为保持一致
+func (h *PeriodLimit) takeLocallyN(key string, n int) (state int, remaining int, retryAfter time.Duration) {
+	h.localLock.Lock()
+	defer h.localLock.Unlock()
+
+	now := time.Now()
+	var bucket *localBucket
+	if v, ok := h.localBuckets.Load(key); ok {
+		bucket = v.(*localBucket)
+	}
+	if bucket == nil || !now.Before(bucket.resetAt) {
+		bucket = &localBucket{resetAt: now.Add(time.Duration(h.period) * time.Second)}
+		h.localBuckets.Store(key, bucket)
+	}
+
+	retryAfter = bucket.resetAt.Sub(now)
+	if bucket.count+n > h.quota {
+		return OverQuota, 0, retryAfter
+	}
+
+	bucket.count += n
+	remaining = h.quota - bucket.count
+	if bucket.count == h.quota {
+		return HitQuota, remaining, retryAfter
+	}
+
+	return Allowed, remaining, retryAfter
+}
+
+// startRescueMonitor 启动一个后台协程定期探测 redis 是否恢复，恢复后重新采用分布式计数，
+// 同一时刻只会有一个探测协程在跑
+func (h *PeriodLimit) startRescueMonitor() {
+	h.rescueLock.Lock()
+	if h.monitoring {
+		h.rescueLock.Unlock()
+		return
+	}
+	h.monitoring = true
+	h.rescueLock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if h.store.Ping() {
+				atomic.StoreUint32(&h.redisAlive, 1)
+				h.rescueLock.Lock()
+				h.monitoring = false
+				h.rescueLock.Unlock()
+				return
+			}
+		}
+	}()
+}
+
+// TakeN 一次性预占 n 个配额，适用于批量操作（比如一次发5条短信，
+// 配额够5条才允许发送）的场景，避免调用方循环调用 Take 带来的竞态和误差。
+// 只支持固定窗口（默认模式），分桶/zset 滑动窗口模式下返回 ErrTakeNUnsupportedWindowMode，
+// 请继续用 Take。与 Take 共用 redis 故障降级和负缓存逻辑，是 Allow 的最终落地实现。
+// 返回值：
+// state 下列任意一个: Allowed|HitQuota|OverQuota
+// remaining 本次请求之后窗口内剩余的配额，OverQuota 时为 0
+// retryAfter 距离窗口重置还需要等待的时间，仅在 OverQuota 时有意义
+func (h *PeriodLimit) TakeN(key string, n int) (state int, remaining int, retryAfter time.Duration, err error) {
+	if n < 1 {
+		return Unknown, 0, 0, ErrInvalidTakeCount
+	}
+
+	if h.windowMode != windowModeFixed {
+		return Unknown, 0, 0, ErrTakeNUnsupportedWindowMode
+	}
+
+	if v, ok := h.negativeCache.Load(key); ok {
+		if resetAt, ok := v.(time.Time); ok && time.Now().Before(resetAt) {
+			return OverQuota, 0, time.Until(resetAt), nil
+		}
+		h.negativeCache.Delete(key)
+	}
+
+	if atomic.LoadUint32(&h.redisAlive) == 0 {
+		state, remaining, retryAfter = h.takeLocallyN(key, n)
+		return state, remaining, retryAfter, nil
+	}
+
+	var exhausted bool
+	state, remaining, retryAfter, exhausted, err = h.takeNRemotely(key, n)
+	if err != nil {
+		logx.Errorf("period limit fall back to local limiter, key: %s, error: %v", key, err)
+		atomic.StoreUint32(&h.redisAlive, 0)
+		h.startRescueMonitor()
+		state, remaining, retryAfter = h.takeLocallyN(key, n)
+		return state, remaining, retryAfter, nil
+	}
+
+	// 命中 OverQuota 的 key 在窗口剩余时间内不再请求 redis，减少热点 key 的压力；
+	// 过期时间直接取脚本返回的真实 PTTL，而不是假定一个完整的 period——Align() 开启时
+	// 真实窗口本来就比 period 短，用 period 会让本地缓存比 redis 多挡一截。
+	// 只有配额确实已经见底（exhausted）才缓存：如果只是这次 n 太大超过了当时剩余的配额，
+	// 后续更小的请求本该还能放行，缓存会把它们也一并挡在外面
+	if state == OverQuota && exhausted {
+		h.negativeCache.Store(key, time.Now().Add(retryAfter))
+	}
+
+	return state, remaining, retryAfter, nil
+}
+
+// takeNRemotely 通过 redis 原子地预占 n 个配额。exhausted 仅在 state 为
+// OverQuota 时有意义，标记配额是不是已经真的见底，供负缓存判断要不要生效
+func (h *PeriodLimit) takeNRemotely(key string, n int) (state int, remaining int, retryAfter time.Duration, exhausted bool, err error) {
+	resp, err := h.store.Eval(takeNScript, []string{h.keyPrefix + key}, []string{
+		strconv.Itoa(h.quota),
+		strconv.Itoa(h.calcExpireSeconds()),
+		strconv.Itoa(n),
+	})
+	if err != nil {
+		return Unknown, 0, 0, false, err
+	}
+
+	fields, ok := resp.([]interface{})
+	if !ok || len(fields) != 4 {
+		return Unknown, 0, 0, false, ErrUnknownCode
+	}
+
+	code, ok1 := fields[0].(int64)
+	left, ok2 := fields[1].(int64)
+	pttl, ok3 := fields[2].(int64)
+	exhaustedFlag, ok4 := fields[3].(int64)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return Unknown, 0, 0, false, ErrUnknownCode
+	}
+
+	retryAfter = time.Duration(pttl) * time.Millisecond
+	switch code {
+	case internalOverQuota:
+		return OverQuota, 0, retryAfter, exhaustedFlag == 1, nil
+	case internalAllowed:
+		return Allowed, int(left), retryAfter, false, nil
+	case internalHitQuota:
+		return HitQuota, int(left), retryAfter, false, nil
+	default:
+		return Unknown, 0, 0, false, ErrUnknownCode
+	}
+}
+
+// Allow 实现 Limiter 接口，语义等价于 TakeN(key, 1)，
+// 返回值中的 ResetAt 由 TakeN 返回的 retryAfter 换算而来。
+// 跟 TakeN 一样只支持固定窗口，分桶/zset 滑动窗口模式下返回 ErrTakeNUnsupportedWindowMode
+func (h *PeriodLimit) Allow(key string) (Result, error) {
+	state, remaining, retryAfter, err := h.TakeN(key, 1)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return Result{
+		State:     state,
+		Remaining: remaining,
+		ResetAt:   time.Now().Add(retryAfter),
+	}, nil
+}
+
 // calcExpireSeconds 计算时间窗口
 // 以下支持两种时间窗口，固定窗口和非固定窗口。具体区别见 PeriodLimit 定义中的注释
 func (h *PeriodLimit) calcExpireSeconds() int {
@@ -155,3 +530,24 @@ func Align() LimitOption {
 		l.align = true
 	}
 }
+
+// WithSlidingWindow 切换为分桶滑动窗口模式，将 period 等分为 buckets 份，
+// 每份分别计数，统计时只累加落在最近一个完整 period 内的桶，
+// 从而避免固定窗口在窗口边界处出现最多2倍quota的突发流量。
+// buckets 越大统计越精确，但 redis 中存储的字段也越多，一般取 10~60 即可。
+func WithSlidingWindow(buckets int) LimitOption {
+	return func(l *PeriodLimit) {
+		l.windowMode = windowModeSlidingBucket
+		l.buckets = buckets
+	}
+}
+
+// WithZSetSlidingWindow 切换为基于 zset 的滑动窗口模式，
+// 每次请求的时间戳都会被记录为 zset 的一个成员，统计时用 ZREMRANGEBYSCORE
+// 清理窗口外的成员再 ZCARD 计数，统计精确到毫秒级，
+// 代价是每个 key 最多需要保存 quota 个成员，相比分桶模式更耗内存。
+func WithZSetSlidingWindow() LimitOption {
+	return func(l *PeriodLimit) {
+		l.windowMode = windowModeSlidingZSet
+	}
+}
@@ -0,0 +1,219 @@
+package limit
+
+import (
+	"testing"
+)
+
+// fakeStore 是一个只记录最近一次 Eval 调用的 Store 假实现，用来验证 Take/TakeN
+// 按 windowMode 分发到了哪个脚本（或者有没有碰脚本），而不依赖真实 redis 执行 Lua
+type fakeStore struct {
+	lastScript string
+	lastKeys   []string
+	lastArgs   []string
+	resp       interface{}
+	err        error
+}
+
+func (s *fakeStore) Eval(script string, keys []string, args []string) (interface{}, error) {
+	s.lastScript = script
+	s.lastKeys = keys
+	s.lastArgs = args
+	return s.resp, s.err
+}
+
+func (s *fakeStore) Ping() bool {
+	return true
+}
+
+func TestWithSlidingWindow(t *testing.T) {
+	l := NewPeriodLimitWithStore(10, 100, NewRedisStore(nil), "rate:", WithSlidingWindow(20))
+	if l.windowMode != windowModeSlidingBucket {
+		t.Fatalf("expected windowModeSlidingBucket, got %d", l.windowMode)
+	}
+	if l.buckets != 20 {
+		t.Fatalf("expected 20 buckets, got %d", l.buckets)
+	}
+}
+
+func TestWithZSetSlidingWindow(t *testing.T) {
+	l := NewPeriodLimitWithStore(10, 100, NewRedisStore(nil), "rate:", WithZSetSlidingWindow())
+	if l.windowMode != windowModeSlidingZSet {
+		t.Fatalf("expected windowModeSlidingZSet, got %d", l.windowMode)
+	}
+}
+
+func TestWithSlidingWindowRejectsZeroBuckets(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic when buckets < 1")
+		}
+	}()
+
+	NewPeriodLimitWithStore(10, 100, &fakeStore{}, "rate:", WithSlidingWindow(0))
+}
+
+// TestTakeDispatchesScriptPerWindowMode 覆盖 chunk0-1 review 指出的问题：分桶/zset
+// 滑动窗口的脚本分发逻辑之前完全没有测试覆盖。借助 fakeStore 只断言 Take 调用了
+// 哪个脚本，不依赖真实 redis 去跑这两个脚本的 Lua 逻辑
+func TestTakeDispatchesScriptPerWindowMode(t *testing.T) {
+	store := &fakeStore{resp: int64(internalAllowed)}
+	l := NewPeriodLimitWithStore(10, 100, store, "rate:", WithSlidingWindow(20))
+	if _, err := l.Take("key"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if store.lastScript != slidingWindowScript {
+		t.Fatal("expected Take to eval slidingWindowScript for windowModeSlidingBucket")
+	}
+
+	store = &fakeStore{resp: int64(internalAllowed)}
+	l = NewPeriodLimitWithStore(10, 100, store, "rate:", WithZSetSlidingWindow())
+	if _, err := l.Take("key"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if store.lastScript != zsetSlidingWindowScript {
+		t.Fatal("expected Take to eval zsetSlidingWindowScript for windowModeSlidingZSet")
+	}
+
+	store = &fakeStore{resp: []interface{}{int64(internalAllowed), int64(99), int64(10000), int64(0)}}
+	l = NewPeriodLimitWithStore(10, 100, store, "rate:")
+	if _, err := l.Take("key"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if store.lastScript != takeNScript {
+		t.Fatal("expected Take to eval takeNScript for windowModeFixed")
+	}
+}
+
+func TestTakeNValidatesCount(t *testing.T) {
+	l := NewPeriodLimitWithStore(10, 100, NewMemoryStore(), "rate:")
+	if _, _, _, err := l.TakeN("key", 0); err != ErrInvalidTakeCount {
+		t.Fatalf("expected ErrInvalidTakeCount for n=0, got %v", err)
+	}
+	if _, _, _, err := l.TakeN("key", -1); err != ErrInvalidTakeCount {
+		t.Fatalf("expected ErrInvalidTakeCount for n=-1, got %v", err)
+	}
+}
+
+// TestTakeNRejectsSlidingWindowModes 覆盖 chunk0-2 review 指出的问题：TakeN/Allow
+// 曾经不管 windowMode 一律跑 takeNScript，分桶/zset 模式下会和 Take 写的
+// HASH/ZSET 打架触发 WRONGTYPE。现在应当在碰 redis 之前就直接拒绝
+func TestTakeNRejectsSlidingWindowModes(t *testing.T) {
+	bucketStore := &fakeStore{resp: int64(internalAllowed)}
+	l := NewPeriodLimitWithStore(10, 100, bucketStore, "rate:", WithSlidingWindow(20))
+	if _, _, _, err := l.TakeN("key", 1); err != ErrTakeNUnsupportedWindowMode {
+		t.Fatalf("expected ErrTakeNUnsupportedWindowMode, got %v", err)
+	}
+	if bucketStore.lastScript != "" {
+		t.Fatal("TakeN should reject before ever touching the store")
+	}
+
+	zsetStore := &fakeStore{resp: int64(internalAllowed)}
+	l = NewPeriodLimitWithStore(10, 100, zsetStore, "rate:", WithZSetSlidingWindow())
+	if _, _, _, err := l.TakeN("key", 1); err != ErrTakeNUnsupportedWindowMode {
+		t.Fatalf("expected ErrTakeNUnsupportedWindowMode, got %v", err)
+	}
+
+	if _, err := l.Allow("key"); err != ErrTakeNUnsupportedWindowMode {
+		t.Fatalf("expected Allow to surface ErrTakeNUnsupportedWindowMode, got %v", err)
+	}
+}
+
+func TestTakeNAllOrNothing(t *testing.T) {
+	l := NewPeriodLimitWithStore(10, 5, NewMemoryStore(), "rate:")
+
+	state, remaining, _, err := l.TakeN("key", 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if state != Allowed || remaining != 2 {
+		t.Fatalf("expected Allowed with 2 remaining, got state=%d remaining=%d", state, remaining)
+	}
+
+	// 剩余配额只有 2，一次性要 3 个应当被整体拒绝，而不是占走 2 个再报错
+	state, remaining, _, err = l.TakeN("key", 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if state != OverQuota || remaining != 0 {
+		t.Fatalf("expected OverQuota with 0 remaining, got state=%d remaining=%d", state, remaining)
+	}
+
+	// 配额应该还剩 2 个没被超额请求污染
+	state, remaining, _, err = l.TakeN("key", 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if state != HitQuota || remaining != 0 {
+		t.Fatalf("expected HitQuota with 0 remaining, got state=%d remaining=%d", state, remaining)
+	}
+}
+
+func TestTakeNNegativeCacheShortCircuits(t *testing.T) {
+	l := NewPeriodLimitWithStore(10, 1, NewMemoryStore(), "rate:")
+
+	if state, _, _, err := l.TakeN("key", 1); err != nil || state != HitQuota {
+		t.Fatalf("expected HitQuota, got state=%d err=%v", state, err)
+	}
+	if state, _, _, err := l.TakeN("key", 1); err != nil || state != OverQuota {
+		t.Fatalf("expected OverQuota, got state=%d err=%v", state, err)
+	}
+
+	if _, ok := l.negativeCache.Load("key"); !ok {
+		t.Fatal("expected negative cache entry after OverQuota")
+	}
+
+	// 负缓存生效期间，后续请求直接返回 OverQuota，不再访问 store
+	store := &fakeStore{}
+	l.store = store
+	if state, _, _, err := l.TakeN("key", 1); err != nil || state != OverQuota {
+		t.Fatalf("expected OverQuota from negative cache, got state=%d err=%v", state, err)
+	}
+	if store.lastScript != "" {
+		t.Fatal("expected negative cache to short-circuit without touching the store")
+	}
+}
+
+func TestTakeDelegatesToTakeNForFixedWindow(t *testing.T) {
+	l := NewPeriodLimitWithStore(10, 1, NewMemoryStore(), "rate:")
+
+	state, err := l.Take("key")
+	if err != nil || state != HitQuota {
+		t.Fatalf("expected HitQuota, got state=%d err=%v", state, err)
+	}
+	state, err = l.Take("key")
+	if err != nil || state != OverQuota {
+		t.Fatalf("expected OverQuota, got state=%d err=%v", state, err)
+	}
+}
+
+func TestTakeLocallyNAllOrNothing(t *testing.T) {
+	l := NewPeriodLimitWithStore(10, 5, NewMemoryStore(), "rate:")
+
+	state, remaining, _ := l.takeLocallyN("key", 4)
+	if state != Allowed || remaining != 1 {
+		t.Fatalf("expected Allowed with 1 remaining, got state=%d remaining=%d", state, remaining)
+	}
+
+	// 本地降级计数同样要求超额时整体拒绝，跟 takeNScript 的回滚语义保持一致
+	state, remaining, _ = l.takeLocallyN("key", 2)
+	if state != OverQuota || remaining != 0 {
+		t.Fatalf("expected OverQuota with 0 remaining, got state=%d remaining=%d", state, remaining)
+	}
+
+	state, remaining, _ = l.takeLocallyN("key", 1)
+	if state != HitQuota || remaining != 0 {
+		t.Fatalf("expected HitQuota with 0 remaining, got state=%d remaining=%d", state, remaining)
+	}
+}
+
+// BenchmarkTakeNFixedWindow 压测 memoryStore 支撑下的固定窗口 TakeN 吞吐。
+// 分桶/zset 滑动窗口模式依赖真实 redis 的 TIME/HGETALL/ZADD 等命令，
+// memoryStore 不支持这两种脚本（见 supportsWindowMode），所以没法在这里压测，
+// 需要对照真实 redis 实例跑。
+func BenchmarkTakeNFixedWindow(b *testing.B) {
+	l := NewPeriodLimitWithStore(60, 1<<30, NewMemoryStore(), "rate:")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, _, _ = l.TakeN("bench-key", 1)
+	}
+}
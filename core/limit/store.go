@@ -0,0 +1,179 @@
+package limit
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tal-tech/go-zero/core/stores/redis"
+	"github.com/tal-tech/go-zero/core/syncx"
+)
+
+// ErrScriptNotSupported 内存 Store 只认识固定窗口的 takeNScript，
+// 遇到滑动窗口脚本时返回这个错误，调用方应该继续用 redis 做滑动窗口限流
+var ErrScriptNotSupported = errors.New("limit: script not supported by this store")
+
+type (
+	// Store 抽象了 PeriodLimit 依赖的底层存储能力，script/keys/args 的含义和 redis
+	// EVAL 命令完全一致，返回值与脚本 return 的值一一对应，使 PeriodLimit 可以跑在
+	// redis、内存（单测用）等不同后端之上，而不用改动调用方代码
+	Store interface {
+		// Eval 执行限流脚本
+		Eval(script string, keys []string, args []string) (interface{}, error)
+		// Ping 探测存储是否存活，配合 redis 故障降级使用
+		Ping() bool
+	}
+
+	// redisStore 用 *redis.Redis 实现 Store，是 PeriodLimit 原来就在用的默认存储
+	redisStore struct {
+		redis *redis.Redis
+	}
+
+	// memoryStore 进程内的 Store 实现，不依赖 redis，主要用于单测；
+	// 目前只支持固定窗口的 takeNScript，滑动窗口模式请继续用 redis
+	memoryStore struct {
+		lock    sync.Mutex
+		buckets *syncx.Map
+	}
+
+	memoryBucket struct {
+		count   int64
+		resetAt time.Time
+	}
+
+	// MultiStore 把同一次 Eval 同时投给 Primary 和 Shadow 两个 Store，限流判断只看
+	// Primary 的结果，Shadow 的调用是 fire-and-forget 的，失败也不影响限流结果。
+	// 用于从一个 Store 后端迁移到另一个后端时做灰度对比
+	MultiStore struct {
+		Primary Store
+		Shadow  Store
+	}
+
+	// windowModeSupporter 是 Store 的可选扩展接口，用来声明自己支持哪些窗口模式。
+	// NewPeriodLimitWithStore 据此在构造期就拒绝不兼容的组合（比如 memoryStore 配
+	// WithSlidingWindow），不去支持的 Store 直接按"什么窗口模式都支持"处理，
+	// 免得所有自定义 Store 实现都要补一个从不拒绝的空实现
+	windowModeSupporter interface {
+		supportsWindowMode(mode int) bool
+	}
+)
+
+// NewRedisStore 用已有的 *redis.Redis 构造一个 Store
+func NewRedisStore(store *redis.Redis) Store {
+	return redisStore{redis: store}
+}
+
+func (s redisStore) Eval(script string, keys []string, args []string) (interface{}, error) {
+	return s.redis.Eval(script, keys, args)
+}
+
+func (s redisStore) Ping() bool {
+	return s.redis.Ping()
+}
+
+// NewMemoryStore 创建一个进程内的 Store，不依赖 redis
+func NewMemoryStore() Store {
+	return &memoryStore{buckets: syncx.NewMap()}
+}
+
+func (s *memoryStore) Eval(script string, keys []string, args []string) (interface{}, error) {
+	switch script {
+	case takeNScript:
+		return s.takeN(keys[0], args)
+	default:
+		return nil, ErrScriptNotSupported
+	}
+}
+
+func (s *memoryStore) Ping() bool {
+	return true
+}
+
+// supportsWindowMode 实现 windowModeSupporter：memoryStore 的 Eval 只认识
+// takeNScript，分桶/zset 滑动窗口脚本一律返回 ErrScriptNotSupported
+func (s *memoryStore) supportsWindowMode(mode int) bool {
+	return mode == windowModeFixed
+}
+
+// bucketForLocked 返回 key 对应的桶，调用方必须持有 s.lock
+func (s *memoryStore) bucketForLocked(key string, window int) *memoryBucket {
+	now := time.Now()
+	var bucket *memoryBucket
+	if v, ok := s.buckets.Load(key); ok {
+		bucket = v.(*memoryBucket)
+	}
+	if bucket == nil || !now.Before(bucket.resetAt) {
+		bucket = &memoryBucket{resetAt: now.Add(time.Duration(window) * time.Second)}
+		s.buckets.Store(key, bucket)
+	}
+
+	return bucket
+}
+
+func (s *memoryStore) takeN(key string, args []string) (interface{}, error) {
+	quota, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, err
+	}
+	window, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	bucket := s.bucketForLocked(key, window)
+	before := bucket.count
+	bucket.count += int64(n)
+	pttl := int64(time.Until(bucket.resetAt) / time.Millisecond)
+
+	if bucket.count > int64(quota) {
+		bucket.count -= int64(n)
+		var exhausted int64
+		if before >= int64(quota) {
+			exhausted = 1
+		}
+		return []interface{}{int64(internalOverQuota), int64(0), pttl, exhausted}, nil
+	}
+
+	remaining := int64(quota) - bucket.count
+	if bucket.count == int64(quota) {
+		return []interface{}{int64(internalHitQuota), remaining, pttl, int64(0)}, nil
+	}
+
+	return []interface{}{int64(internalAllowed), remaining, pttl, int64(0)}, nil
+}
+
+// NewMultiStore 构造一个同时写 primary 和 shadow 的 Store，限流结果只取决于 primary
+func NewMultiStore(primary, shadow Store) Store {
+	return MultiStore{Primary: primary, Shadow: shadow}
+}
+
+func (m MultiStore) Eval(script string, keys []string, args []string) (interface{}, error) {
+	if m.Shadow != nil {
+		go func() {
+			_, _ = m.Shadow.Eval(script, keys, args)
+		}()
+	}
+
+	return m.Primary.Eval(script, keys, args)
+}
+
+func (m MultiStore) Ping() bool {
+	return m.Primary.Ping()
+}
+
+// supportsWindowMode 实现 windowModeSupporter，窗口模式是否支持只看 Primary，
+// Shadow 本来就是 fire-and-forget，不影响限流判断
+func (m MultiStore) supportsWindowMode(mode int) bool {
+	if s, ok := m.Primary.(windowModeSupporter); ok {
+		return s.supportsWindowMode(mode)
+	}
+
+	return true
+}
@@ -0,0 +1,114 @@
+package limit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreTakeN(t *testing.T) {
+	store := NewMemoryStore()
+	key := "k1"
+
+	resp, err := store.Eval(takeNScript, []string{key}, []string{"3", "1", "2"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fields, ok := resp.([]interface{})
+	if !ok || len(fields) != 4 {
+		t.Fatalf("unexpected response shape: %#v", resp)
+	}
+	if fields[0].(int64) != internalAllowed {
+		t.Fatalf("expected allowed, got %v", fields[0])
+	}
+	if fields[1].(int64) != 1 {
+		t.Fatalf("expected 1 remaining, got %v", fields[1])
+	}
+
+	// 再占 1 个，正好用满配额 3
+	resp, err = store.Eval(takeNScript, []string{key}, []string{"3", "1", "1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fields = resp.([]interface{})
+	if fields[0].(int64) != internalHitQuota {
+		t.Fatalf("expected hit quota, got %v", fields[0])
+	}
+
+	// 配额已经用满，超额的 1 个应当被整体拒绝并回滚
+	resp, err = store.Eval(takeNScript, []string{key}, []string{"3", "1", "1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fields = resp.([]interface{})
+	if fields[0].(int64) != internalOverQuota {
+		t.Fatalf("expected over quota, got %v", fields[0])
+	}
+	if fields[1].(int64) != 0 {
+		t.Fatalf("expected 0 remaining on over quota, got %v", fields[1])
+	}
+}
+
+func TestMemoryStoreEvalUnsupportedScript(t *testing.T) {
+	store := NewMemoryStore()
+	if _, err := store.Eval(slidingWindowScript, []string{"k"}, nil); err != ErrScriptNotSupported {
+		t.Fatalf("expected ErrScriptNotSupported, got %v", err)
+	}
+}
+
+func TestMemoryStorePing(t *testing.T) {
+	store := NewMemoryStore()
+	if !store.Ping() {
+		t.Fatal("memoryStore should always be alive")
+	}
+}
+
+func TestMultiStoreEval(t *testing.T) {
+	primary := NewMemoryStore()
+	shadow := NewMemoryStore()
+	multi := NewMultiStore(primary, shadow)
+
+	resp, err := multi.Eval(takeNScript, []string{"k"}, []string{"5", "1", "1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp.([]interface{})[0].(int64) != internalAllowed {
+		t.Fatalf("expected allowed from primary, got %#v", resp)
+	}
+
+	// shadow 的写入是异步 fire-and-forget 的，稍等一下再校验它确实也收到了请求
+	time.Sleep(10 * time.Millisecond)
+	shadowResp, err := shadow.Eval(takeNScript, []string{"k"}, []string{"5", "1", "0"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if shadowResp.([]interface{})[1].(int64) != 4 {
+		t.Fatalf("expected shadow store to have observed the earlier write, remaining=%v", shadowResp.([]interface{})[1])
+	}
+}
+
+func TestMultiStorePing(t *testing.T) {
+	multi := NewMultiStore(NewMemoryStore(), NewMemoryStore())
+	if !multi.Ping() {
+		t.Fatal("expected multi store to be alive when primary is alive")
+	}
+}
+
+func TestNewPeriodLimitWithStoreRejectsUnsupportedWindowMode(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic when combining memoryStore with WithSlidingWindow")
+		}
+	}()
+
+	NewPeriodLimitWithStore(10, 100, NewMemoryStore(), "rate:", WithSlidingWindow(10))
+}
+
+func TestNewPeriodLimitWithStoreAllowsFixedWindowOnMemoryStore(t *testing.T) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("unexpected panic: %v", r)
+		}
+	}()
+
+	NewPeriodLimitWithStore(10, 100, NewMemoryStore(), "rate:")
+}